@@ -0,0 +1,170 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"context"
+	"time"
+
+	logging "github.com/op/go-logging"
+
+	"github.com/hyperledger-labs/minbft/api"
+	"github.com/hyperledger-labs/minbft/core/internal/clientstate"
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+// Replica is the assembled request-processing surface of a single
+// replica instance: the entry point that wires together the
+// standalone pipeline stages defined throughout this package into
+// something a caller outside it can drive. New builds it up
+// incrementally as the subsystems it depends on come online; see the
+// other make*/new* constructors in this package for the pieces it
+// assembles.
+type Replica struct {
+	id uint32
+
+	process requestProcessor
+	execute requestExecutor
+
+	pipeline *requestPipeline
+	health   *clientHealthMonitor
+
+	onViewChanged      viewChangedHandler
+	onRequestCommitted requestCommittedHandler
+}
+
+// New constructs a Replica for replica id among n replicas, using
+// config for its tunables and provideClientState to look up
+// per-client request timer and sequence state, logging client health
+// transitions through logger. backoffCeiling caps the adaptive
+// request timeout's exponential backoff across consecutive view
+// changes; a zero backoffCeiling selects
+// defaultRequestTimeoutBackoffCeiling. verify authenticates incoming
+// Request messages; view and handleGeneratedUIMessage let the primary
+// generate a Prepare once a Request has been processed. consumer runs
+// the operation carried by a committed Request; handleGeneratedMessage
+// delivers the signed Reply, via sign, back towards the client. store
+// durably tracks execution so that Execute survives a crash between an
+// operation completing and its Reply being delivered; replayPendingJobs
+// re-drives whatever store reports pending from a previous run.
+// extraProcessorInterceptors and extraExecutorInterceptors, if any,
+// are appended after the interceptors New wires in by default, i.e.
+// the shutdown drainer on both chains and, on the execution chain, the
+// serialization guard.
+func New(id, n uint32, config api.Configer, provideClientState clientstate.Provider, logger *logging.Logger, backoffCeiling uint32, verify messageSignatureVerifier, view viewProvider, handleGeneratedUIMessage generatedUIMessageHandler, handleGeneratedMessage generatedMessageHandler, consumer api.RequestConsumer, sign replicaMessageSigner, store RequestJobStore, extraProcessorInterceptors, extraExecutorInterceptors []RequestInterceptor) (*Replica, error) {
+	health := newClientHealthMonitor(logger)
+
+	provideTimeout, onViewChanged, onRequestCommitted := makeRequestTimeoutProvider(config, backoffCeiling)
+
+	// TODO: handleTimeout should trigger a view change once the
+	// view-change subsystem is wired in; for now, expiration is only
+	// observed by health.
+	handleTimeout := func(view uint64) {}
+
+	drainer := &requestDrainer{}
+
+	processorInterceptors := append([]RequestInterceptor{drainer}, extraProcessorInterceptors...)
+	executorInterceptors := append([]RequestInterceptor{drainer, newSerializationInterceptor()}, extraExecutorInterceptors...)
+
+	captureSeq := makeRequestSeqCapturer(provideClientState)
+	applyRequest := makeRequestApplier(id, n, view, handleGeneratedUIMessage)
+
+	validate := makeRequestValidator(verify, nil)
+	process := makeRequestProcessor(captureSeq, applyRequest, processorInterceptors)
+
+	// Concurrent invocation of the operation executor is not safe;
+	// the serializationInterceptor wired in ahead of it above is what
+	// actually enforces that, so the queue itself only needs a single
+	// worker.
+	const executorConcurrency = 1
+	operationExecute := makeOperationExecutor(consumer)
+	execute, queue := makeRequestExecutor(id, operationExecute, sign, handleGeneratedMessage, store, executorConcurrency, health, executorInterceptors)
+
+	startTimer := makeRequestTimerStarter(provideClientState, provideTimeout, handleTimeout, health)
+	stopTimer := makeRequestTimerStopper(provideClientState)
+
+	pipeline := newRequestPipeline(validate, startTimer, stopTimer, drainer, queue)
+
+	replayPendingJobs(store, queue)
+
+	return &Replica{
+		id:                 id,
+		process:            process,
+		execute:            execute,
+		pipeline:           pipeline,
+		health:             health,
+		onViewChanged:      onViewChanged,
+		onRequestCommitted: onRequestCommitted,
+	}, nil
+}
+
+// Validate authenticates and checks request for internal consistency,
+// without touching replica state. It rejects request once Shutdown
+// has begun.
+func (r *Replica) Validate(request *messages.Request) error {
+	return r.pipeline.Validate(request)
+}
+
+// Process fully processes a valid request, reporting whether this
+// replica has not processed it before.
+func (r *Replica) Process(request *messages.Request) (new bool, err error) {
+	return r.process(request)
+}
+
+// Execute runs the operation carried by request and delivers its
+// signed Reply, durably, via the job queue built by New.
+func (r *Replica) Execute(request *messages.Request) {
+	r.execute(request)
+}
+
+// StartTimer starts the request timer for clientID in the given view.
+func (r *Replica) StartTimer(clientID uint32, view uint64) {
+	r.pipeline.StartTimer(clientID, view)
+}
+
+// StopTimer stops the outstanding request timer for clientID, if any.
+func (r *Replica) StopTimer(clientID uint32) {
+	r.pipeline.StopTimer(clientID)
+}
+
+// Shutdown gracefully quiesces request processing: see
+// requestPipeline.Shutdown.
+func (r *Replica) Shutdown(ctx context.Context) error {
+	return r.pipeline.Shutdown(ctx)
+}
+
+// OnViewChanged notifies the replica's adaptive request timeout that a
+// view change has taken place.
+func (r *Replica) OnViewChanged() {
+	r.onViewChanged()
+}
+
+// OnRequestCommitted notifies the replica's adaptive request timeout
+// that a Request has been committed in the current view.
+func (r *Replica) OnRequestCommitted() {
+	r.onRequestCommitted()
+}
+
+// ClientHealth reports the observed health of clientID's request
+// stream, as tracked by the replica's clientHealthMonitor: whether its
+// most recent request timer expired without a matching Reply, the
+// time of its last Reply, and its current count of consecutive
+// timeouts.
+func (r *Replica) ClientHealth(clientID uint32) (stalled bool, lastReplyAt time.Time, consecutiveTimeouts int) {
+	return r.health.ClientHealth(clientID)
+}
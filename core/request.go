@@ -18,7 +18,10 @@
 package minbft
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -124,30 +127,115 @@ type requestTimeoutHandler func(view uint64)
 // requestTimeoutProvider returns current request timeout duration.
 type requestTimeoutProvider func() time.Duration
 
+// viewChangedHandler notifies the request timeout provider that a
+// view change has taken place, so that it can back off the request
+// timeout to account for the increased network delay typically
+// observed around a view change.
+type viewChangedHandler func()
+
+// requestCommittedHandler notifies the request timeout provider that
+// a Request message has been committed in the current view, so that
+// it can gradually decay the timeout back towards its base value once
+// the replica set has proven to be making progress again.
+type requestCommittedHandler func()
+
+// RequestInterceptor allows user-supplied code to observe, or
+// short-circuit, the processing of a Request message at each stage of
+// the pipeline (validation, processing, execution) without forking
+// the core package. This is the extension point for things like
+// metrics, tracing, rate limiting, per-client ACLs, and audit
+// logging.
+//
+// Given a chain of interceptors, Before is invoked on each of them in
+// order, and After on each of them in reverse order, around the
+// wrapped stage. It is safe to invoke both methods concurrently.
+type RequestInterceptor interface {
+	// Before is invoked prior to the wrapped stage. Returning an
+	// error short-circuits the stage: neither the remaining
+	// interceptors nor the wrapped stage are invoked, and the
+	// error is returned to the caller of the stage.
+	Before(ctx context.Context, request *messages.Request) error
+
+	// After is invoked once the wrapped stage has completed,
+	// whether or not it, or an earlier Before, failed. result
+	// carries whatever the wrapped stage produced, if anything;
+	// it is nil if the stage itself returns no value or the
+	// chain was short-circuited. After cannot alter the outcome
+	// of the stage; it is meant for observation only.
+	After(ctx context.Context, request *messages.Request, result interface{}, err error)
+}
+
+// runInterceptedStage runs stage wrapped by interceptors: Before of
+// every interceptor, in order, then stage unless a Before call
+// failed, then After of every interceptor whose Before actually ran,
+// in reverse order. The interceptor whose Before short-circuited the
+// chain is included in the After pass; one that never got a chance to
+// run because an earlier Before failed first is excluded. A panic raised
+// by stage is recovered, reported to the interceptors as the stage's
+// error, and re-raised once every eligible After has run, so that
+// interceptors still observe failed executions.
+func runInterceptedStage(ctx context.Context, interceptors []RequestInterceptor, request *messages.Request, stage func() (interface{}, error)) (result interface{}, err error) {
+	ran := 0
+
+	defer func() {
+		p := recover()
+		if p != nil {
+			err = fmt.Errorf("Request processing panicked: %v", p)
+		}
+		for i := ran - 1; i >= 0; i-- {
+			interceptors[i].After(ctx, request, result, err)
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	for _, interceptor := range interceptors {
+		ran++
+		if err := interceptor.Before(ctx, request); err != nil {
+			return nil, err
+		}
+	}
+
+	return stage()
+}
+
 // makeRequestValidator constructs an instance of requestValidator
-// using the supplied abstractions.
-func makeRequestValidator(verify messageSignatureVerifier) requestValidator {
+// using the supplied abstractions. Every interceptor in interceptors
+// runs Before and After the actual validation.
+func makeRequestValidator(verify messageSignatureVerifier, interceptors []RequestInterceptor) requestValidator {
 	return func(request *messages.Request) error {
-		return verify(request)
+		_, err := runInterceptedStage(context.Background(), interceptors, request, func() (interface{}, error) {
+			return nil, verify(request)
+		})
+		return err
 	}
 }
 
 // makeRequestProcessor constructs an instance of requestProcessor
 // using id as the current replica ID, n as the total number of nodes,
-// and the supplied abstractions.
-func makeRequestProcessor(captureSeq requestSeqCapturer, applyRequest requestApplier) requestProcessor {
+// and the supplied abstractions. Every interceptor in interceptors
+// runs Before and After the actual processing.
+func makeRequestProcessor(captureSeq requestSeqCapturer, applyRequest requestApplier, interceptors []RequestInterceptor) requestProcessor {
 	return func(request *messages.Request) (new bool, err error) {
-		new, releaseSeq := captureSeq(request)
-		if !new {
-			return false, nil
-		}
-		defer releaseSeq()
+		result, err := runInterceptedStage(context.Background(), interceptors, request, func() (interface{}, error) {
+			new, releaseSeq := captureSeq(request)
+			if !new {
+				return false, nil
+			}
+			defer releaseSeq()
 
-		if err := applyRequest(request); err != nil {
-			return false, fmt.Errorf("Failed to apply Request: %s", err)
+			if err := applyRequest(request); err != nil {
+				return false, fmt.Errorf("Failed to apply Request: %s", err)
+			}
+
+			return true, nil
+		})
+		if err != nil {
+			return false, err
 		}
 
-		return true, nil
+		return result.(bool), nil
 	}
 }
 
@@ -184,42 +272,463 @@ func makeRequestReplier(provider clientstate.Provider) requestReplier {
 	}
 }
 
-// makeRequestExecutor constructs an instance of requestExecutor using
-// the supplied replica ID, operation executor, message signer, and
-// reply consumer.
-func makeRequestExecutor(id uint32, executor operationExecutor, signer replicaMessageSigner, handleGeneratedMessage generatedMessageHandler) requestExecutor {
-	return func(request *messages.Request) {
-		resultChan := executor(request.Msg.Payload)
-		go func() {
-			result := <-resultChan
+// requestKey identifies a Request message by the client that
+// submitted it and the client-assigned sequence number, for use as a
+// map key by RequestJobStore implementations.
+type requestKey struct {
+	clientID uint32
+	seq      uint64
+}
 
-			reply := &messages.Reply{
-				Msg: &messages.Reply_M{
-					ReplicaId: id,
-					ClientId:  request.Msg.ClientId,
-					Seq:       request.Msg.Seq,
-					Result:    result,
-				},
+// Job is a snapshot of the execution lifecycle of a single Request,
+// as tracked by a RequestJobStore.
+type Job struct {
+	Request   *messages.Request
+	Executing bool
+	Completed bool
+	Delivered bool
+	Result    []byte
+	Signature []byte
+}
+
+// RequestJobStore durably tracks the execution lifecycle of accepted
+// Request messages, so that a Reply computed, but not yet delivered,
+// before a crash can be re-driven on restart via PendingJobs instead
+// of leaving the submitting client waiting forever for a Reply that
+// will never come. Completion and delivery are tracked as separate
+// steps, rather than collapsing delivery into MarkCompleted, so that a
+// crash between the two still leaves the job pending: replaying it
+// only has to re-deliver the already-computed Result and Signature,
+// not re-execute the operation.
+type RequestJobStore interface {
+	// Enqueue records request as accepted and awaiting execution.
+	// Enqueuing the same client/seq pair more than once is a no-op.
+	Enqueue(request *messages.Request) error
+
+	// MarkExecuting records that execution of the request
+	// identified by clientID and seq has started.
+	MarkExecuting(clientID uint32, seq uint64) error
+
+	// MarkCompleted records the result and signature of the Reply
+	// produced for the request identified by clientID and seq. The
+	// job is not yet considered delivered: see MarkDelivered.
+	MarkCompleted(clientID uint32, seq uint64, result, signature []byte) error
+
+	// MarkDelivered records that the Reply produced for the request
+	// identified by clientID and seq has been handed to
+	// handleGeneratedMessage. The request must have been marked
+	// completed already.
+	MarkDelivered(clientID uint32, seq uint64) error
+
+	// PendingJobs returns every job that was enqueued, but not yet
+	// delivered, in the order it was enqueued. A job that is
+	// Completed but not Delivered carries its already-computed
+	// Result and Signature, so replaying it should redeliver them
+	// rather than re-execute the operation.
+	PendingJobs() []Job
+}
+
+// memoryJobStore is the default, non-durable RequestJobStore: it
+// keeps the job lifecycle in memory only, so PendingJobs is empty
+// after every restart. A durable implementation, e.g. backed by
+// BoltDB, is a pluggable alternative for deployments that need
+// crash-recovery replay across restarts.
+type memoryJobStore struct {
+	mu    sync.Mutex
+	jobs  map[requestKey]*Job
+	order []requestKey
+}
+
+// NewMemoryJobStore constructs the default, non-durable
+// RequestJobStore.
+func NewMemoryJobStore() RequestJobStore {
+	return &memoryJobStore{jobs: make(map[requestKey]*Job)}
+}
+
+func (s *memoryJobStore) Enqueue(request *messages.Request) error {
+	key := requestKey{request.Msg.ClientId, request.Msg.Seq}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[key]; ok {
+		return nil
+	}
+
+	s.jobs[key] = &Job{Request: request}
+	s.order = append(s.order, key)
+
+	return nil
+}
+
+func (s *memoryJobStore) MarkExecuting(clientID uint32, seq uint64) error {
+	job, err := s.lookup(clientID, seq)
+	if err != nil {
+		return err
+	}
+
+	job.Executing = true
+
+	return nil
+}
+
+func (s *memoryJobStore) MarkCompleted(clientID uint32, seq uint64, result, signature []byte) error {
+	job, err := s.lookup(clientID, seq)
+	if err != nil {
+		return err
+	}
+
+	job.Result = result
+	job.Signature = signature
+	job.Completed = true
+
+	return nil
+}
+
+func (s *memoryJobStore) MarkDelivered(clientID uint32, seq uint64) error {
+	job, err := s.lookup(clientID, seq)
+	if err != nil {
+		return err
+	}
+
+	job.Delivered = true
+
+	return nil
+}
+
+func (s *memoryJobStore) lookup(clientID uint32, seq uint64) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[requestKey{clientID, seq}]
+	if !ok {
+		return nil, fmt.Errorf("Request job not found: client=%d seq=%d", clientID, seq)
+	}
+
+	return job, nil
+}
+
+func (s *memoryJobStore) PendingJobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := make([]Job, 0, len(s.order))
+	for _, key := range s.order {
+		if job := s.jobs[key]; !job.Delivered {
+			pending = append(pending, *job)
+		}
+	}
+
+	return pending
+}
+
+// RequestJobQueueMetrics reports the instantaneous state of a
+// requestJobQueue, for operators to build dashboards and alerts on.
+type RequestJobQueueMetrics struct {
+	QueueDepth  int32
+	RetryCount  uint64
+	LastLatency time.Duration
+}
+
+// requestJobQueue runs accepted Request executions through a pool of
+// worker goroutines, persisting their lifecycle in a RequestJobStore
+// so that execution survives a crash between the operation completing
+// and its Reply being signed and delivered; see replayPendingJobs.
+// Shutdown stops every worker goroutine it started, so that a replica
+// tearing down its request pipeline does not leak them.
+type requestJobQueue struct {
+	id         uint32
+	execute    operationExecutor
+	sign       replicaMessageSigner
+	onComplete func(request *messages.Request, reply *messages.Reply)
+	store      RequestJobStore
+
+	jobs    chan Job
+	workers sync.WaitGroup
+
+	depth       int32
+	retries     uint64
+	lastLatency int64 // atomic: nanoseconds, time.Duration
+}
+
+// newRequestJobQueue constructs a requestJobQueue storing job
+// lifecycle in store and running up to concurrency executions at
+// once. concurrency greater than one is only safe if execute is
+// itself safe for concurrent invocation; the replica constructor is
+// expected to default it to 1 to respect the single-operation-at-a-time
+// constraint described at makeOperationExecutor.
+func newRequestJobQueue(id uint32, execute operationExecutor, sign replicaMessageSigner, onComplete func(request *messages.Request, reply *messages.Reply), store RequestJobStore, concurrency int) *requestJobQueue {
+	q := &requestJobQueue{
+		id:         id,
+		execute:    execute,
+		sign:       sign,
+		onComplete: onComplete,
+		store:      store,
+		jobs:       make(chan Job, 1),
+	}
+
+	for i := 0; i < concurrency; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+
+	return q
+}
+
+// Shutdown closes the queue to further work and waits for every worker
+// goroutine to exit. The caller must ensure Submit is no longer called
+// once Shutdown has been invoked, and that every request already
+// submitted is allowed to finish first, e.g. by draining
+// requestDrainer.inFlight, since a worker still has to consume whatever
+// is left in the channel before it observes the close. If ctx is done
+// before every worker has exited, Shutdown gives up waiting and returns
+// an error.
+func (q *requestJobQueue) Shutdown(ctx context.Context) error {
+	close(q.jobs)
+
+	stopped := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for request job queue workers to stop")
+	}
+}
+
+// Submit persists request as accepted and hands it to a worker
+// goroutine for execution. It is safe to invoke concurrently.
+func (q *requestJobQueue) Submit(request *messages.Request) {
+	if err := q.store.Enqueue(request); err != nil {
+		panic(fmt.Sprintf("Failed to persist Request job: %s", err))
+	}
+
+	q.submit(Job{Request: request})
+}
+
+// submit hands job to a worker goroutine, without touching the store:
+// the caller is responsible for job already being durably recorded,
+// e.g. via a prior Enqueue, or because it was returned by
+// store.PendingJobs in the first place.
+func (q *requestJobQueue) submit(job Job) {
+	atomic.AddInt32(&q.depth, 1)
+	q.jobs <- job
+}
+
+// Metrics returns the current queue depth, cumulative retry count,
+// and latency of the most recently completed execution.
+func (q *requestJobQueue) Metrics() RequestJobQueueMetrics {
+	return RequestJobQueueMetrics{
+		QueueDepth:  atomic.LoadInt32(&q.depth),
+		RetryCount:  atomic.LoadUint64(&q.retries),
+		LastLatency: time.Duration(atomic.LoadInt64(&q.lastLatency)),
+	}
+}
+
+func (q *requestJobQueue) worker() {
+	defer q.workers.Done()
+
+	for job := range q.jobs {
+		q.run(job)
+	}
+}
+
+// run executes job's operation and delivers its Reply, unless job is
+// already Completed, e.g. because it was resubmitted by
+// replayPendingJobs after a crash between MarkCompleted and
+// MarkDelivered, in which case it only redelivers the already-computed
+// Result and Signature, without executing the operation again.
+func (q *requestJobQueue) run(job Job) {
+	defer atomic.AddInt32(&q.depth, -1)
+
+	if job.Completed {
+		q.redeliver(job)
+		return
+	}
+
+	request := job.Request
+	clientID, seq := request.Msg.ClientId, request.Msg.Seq
+
+	if err := q.store.MarkExecuting(clientID, seq); err != nil {
+		panic(fmt.Sprintf("Failed to persist Request job: %s", err))
+	}
+
+	start := time.Now()
+	result := <-q.execute(request.Msg.Payload)
+	atomic.StoreInt64(&q.lastLatency, int64(time.Since(start)))
+
+	reply := &messages.Reply{
+		Msg: &messages.Reply_M{
+			ReplicaId: q.id,
+			ClientId:  clientID,
+			Seq:       seq,
+			Result:    result,
+		},
+	}
+	q.sign(reply)
+
+	if err := q.store.MarkCompleted(clientID, seq, result, reply.Signature); err != nil {
+		panic(fmt.Sprintf("Failed to persist Request job: %s", err))
+	}
+
+	q.redeliver(Job{Request: request, Completed: true, Result: result, Signature: reply.Signature})
+}
+
+// redeliver hands job's already-computed Reply to onComplete and only
+// then marks it delivered, so that a crash during onComplete, e.g.
+// before handleGeneratedMessage returns, leaves the job pending for
+// another replay instead of losing the Reply for good.
+func (q *requestJobQueue) redeliver(job Job) {
+	clientID, seq := job.Request.Msg.ClientId, job.Request.Msg.Seq
+
+	reply := &messages.Reply{
+		Msg: &messages.Reply_M{
+			ReplicaId: q.id,
+			ClientId:  clientID,
+			Seq:       seq,
+			Result:    job.Result,
+		},
+		Signature: job.Signature,
+	}
+
+	q.onComplete(job.Request, reply)
+
+	if err := q.store.MarkDelivered(clientID, seq); err != nil {
+		panic(fmt.Sprintf("Failed to persist Request job: %s", err))
+	}
+}
+
+// replayPendingJobs re-submits every job returned by store.PendingJobs
+// to queue. It is meant to be invoked once by the replica constructor
+// during startup, to re-drive every Request that was accepted, but
+// whose Reply was never delivered, before a crash.
+// Jobs already marked executing, but not completed, are re-submitted
+// for execution too, since the in-memory executor state of an
+// interrupted execution cannot be trusted; operationExecutor is
+// expected to be idempotent for a given payload, as the underlying
+// replicated state machine already has to tolerate Reply re-delivery
+// to clients. Jobs already completed, but not delivered, are
+// re-submitted for redelivery only, without executing the operation
+// again.
+func replayPendingJobs(store RequestJobStore, queue *requestJobQueue) {
+	for _, job := range store.PendingJobs() {
+		atomic.AddUint64(&queue.retries, 1)
+		queue.submit(job)
+	}
+}
+
+// makeRequestExecutor constructs an instance of requestExecutor backed
+// by a requestJobQueue using store for durability and running up to
+// concurrency executions at once, using the supplied replica ID,
+// operation executor, message signer, and reply consumer. Every
+// interceptor in interceptors runs Before the Request is submitted to
+// the queue, and After its Reply has been signed, with the Reply as
+// result; this mirrors runInterceptedStage, except that, because
+// submission is asynchronous, After cannot run in the same call frame
+// as Before on the success path, so the pairing is tracked explicitly
+// instead: if a Before fails, After runs immediately, in reverse
+// order, only on the interceptors whose Before already ran; if every
+// Before succeeds, After instead runs on all of them, in reverse
+// order, once the queue has signed the Reply. health is notified of
+// every signed Reply, so that it can clear the client's stalled state,
+// if any: see clientHealthMonitor. The underlying requestJobQueue is
+// also returned so that it can be handed to newRequestPipeline, which
+// needs it to stop the queue's worker goroutines on Shutdown.
+func makeRequestExecutor(id uint32, executor operationExecutor, signer replicaMessageSigner, handleGeneratedMessage generatedMessageHandler, store RequestJobStore, concurrency int, health *clientHealthMonitor, interceptors []RequestInterceptor) (requestExecutor, *requestJobQueue) {
+	ctx := context.Background()
+
+	// submitted holds every Request whose Before pass succeeded; a job
+	// re-driven by replayPendingJobs never had Before run, so its
+	// completion skips the After pass.
+	var submitted sync.Map
+
+	queue := newRequestJobQueue(id, executor, signer, func(request *messages.Request, reply *messages.Reply) {
+		health.onReply(reply.Msg.ClientId, time.Now())
+		handleGeneratedMessage(reply)
+
+		if _, ok := submitted.LoadAndDelete(requestKey{request.Msg.ClientId, request.Msg.Seq}); !ok {
+			return
+		}
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptors[i].After(ctx, request, reply, nil)
+		}
+	}, store, concurrency)
+
+	execute := func(request *messages.Request) {
+		ran := 0
+		for _, interceptor := range interceptors {
+			ran++
+			if err := interceptor.Before(ctx, request); err != nil {
+				health.logger.Warningf("Request dropped before execution: client=%d seq=%d: %s", request.Msg.ClientId, request.Msg.Seq, err)
+				for i := ran - 1; i >= 0; i-- {
+					interceptors[i].After(ctx, request, nil, err)
+				}
+				return
 			}
-			signer(reply)
-			handleGeneratedMessage(reply)
-		}()
+		}
+
+		submitted.Store(requestKey{request.Msg.ClientId, request.Msg.Seq}, struct{}{})
+		queue.Submit(request)
 	}
+
+	return execute, queue
+}
+
+// serializationInterceptor is the default RequestInterceptor the
+// replica constructor is expected to wire in ahead of any user-supplied
+// executor interceptor, to enforce that operationExecutor, which is
+// not safe for concurrent invocation, is never entered while a previous
+// execution is still outstanding. It replaces the unconditional panic
+// operationExecutor used to raise on this condition: a concurrency
+// violation is now rejected and logged by makeRequestExecutor rather
+// than crashing the process, so the offending request is dropped
+// instead of taking the replica down with it. Deployments that need a
+// different policy, e.g. queuing overlapping requests instead of
+// rejecting them, can supply their own RequestInterceptor in its
+// place.
+type serializationInterceptor struct {
+	busy uint32
+}
+
+// newSerializationInterceptor constructs the default
+// RequestInterceptor enforcing single-operation-at-a-time execution.
+func newSerializationInterceptor() RequestInterceptor {
+	return &serializationInterceptor{}
+}
+
+// errConcurrentExecution is wrapped by the error serializationInterceptor
+// returns from Before when it rejects a request.
+var errConcurrentExecution = errors.New("Concurrent operation execution detected")
+
+func (si *serializationInterceptor) Before(ctx context.Context, request *messages.Request) error {
+	if wasBusy := atomic.SwapUint32(&si.busy, 1); wasBusy != 0 {
+		return fmt.Errorf("%w: client=%d seq=%d", errConcurrentExecution, request.Msg.ClientId, request.Msg.Seq)
+	}
+	return nil
+}
+
+func (si *serializationInterceptor) After(ctx context.Context, request *messages.Request, result interface{}, err error) {
+	// A request rejected by Before leaves the outstanding execution
+	// holding the guard.
+	if errors.Is(err, errConcurrentExecution) {
+		return
+	}
+	atomic.StoreUint32(&si.busy, 0)
 }
 
 // makeOperationExecutor constructs an instance of operationExecutor
 // using the supplied interface to external request consumer module.
+// Concurrent invocation of the returned operationExecutor is not
+// allowed; serializing access to it is the responsibility of the
+// serializationInterceptor wired in ahead of it in the requestExecutor
+// interceptor chain.
 func makeOperationExecutor(consumer api.RequestConsumer) operationExecutor {
-	busy := uint32(0) // atomic flag to check for concurrent execution
-
 	return func(op []byte) <-chan []byte {
-		if wasBusy := atomic.SwapUint32(&busy, uint32(1)); wasBusy != uint32(0) {
-			panic("Concurrent operation execution detected")
-		}
-		resultChan := consumer.Deliver(op)
-		atomic.StoreUint32(&busy, uint32(0))
-
-		return resultChan
+		return consumer.Deliver(op)
 	}
 }
 
@@ -269,11 +778,15 @@ func makeRequestSeqRetirer(provideClientState clientstate.Provider) requestSeqRe
 }
 
 // makeRequestTimerStarter constructs an instance of
-// requestTimerStarter.
-func makeRequestTimerStarter(provideClientState clientstate.Provider, handleTimeout requestTimeoutHandler, logger *logging.Logger) requestTimerStarter {
+// requestTimerStarter. The supplied provideTimeout is consulted on
+// every call so that each started timer uses the currently-adjusted
+// request timeout duration, rather than a value fixed at
+// construction time. Expiration is reported to health, which is
+// responsible for logging: see clientHealthMonitor.
+func makeRequestTimerStarter(provideClientState clientstate.Provider, provideTimeout requestTimeoutProvider, handleTimeout requestTimeoutHandler, health *clientHealthMonitor) requestTimerStarter {
 	return func(clientID uint32, view uint64) {
-		provideClientState(clientID).StartRequestTimer(func() {
-			logger.Warningf("Request timer expired: client=%d view=%d", clientID, view)
+		provideClientState(clientID).StartRequestTimer(provideTimeout(), func() {
+			health.onTimeout(clientID)
 			handleTimeout(view)
 		})
 	}
@@ -287,16 +800,332 @@ func makeRequestTimerStopper(provideClientState clientstate.Provider) requestTim
 	}
 }
 
+// requestTimeoutDecayThreshold is the number of Request messages that
+// need to be committed in the current view before the adaptive
+// request timeout decays by one exponential step. It is kept as a
+// constant rather than a configuration knob until experience shows a
+// single default does not fit common deployments.
+const requestTimeoutDecayThreshold = 10
+
+// defaultRequestTimeoutBackoffCeiling is the default cap on the number
+// of consecutive view changes that are allowed to inflate the base
+// timeout, so that the exponential backoff cannot grow without bound,
+// used whenever makeRequestTimeoutProvider is not given an explicit,
+// operator-configured ceiling.
+const defaultRequestTimeoutBackoffCeiling = 6
+
+// adaptiveRequestTimeout implements exponential backoff of the
+// request timeout across view changes, decaying back towards the
+// base timeout as requests keep being committed in the current view.
+//
+// It is safe to invoke its methods concurrently.
+type adaptiveRequestTimeout struct {
+	sync.Mutex
+
+	base    time.Duration
+	ceiling uint32
+
+	viewChanges uint32
+	committed   uint32
+}
+
+// newAdaptiveRequestTimeout constructs an adaptiveRequestTimeout
+// backing off from base, capped at ceiling consecutive view changes.
+func newAdaptiveRequestTimeout(base time.Duration, ceiling uint32) *adaptiveRequestTimeout {
+	return &adaptiveRequestTimeout{base: base, ceiling: ceiling}
+}
+
+// duration returns the currently-adjusted request timeout, i.e.
+// base*2^k where k is the number of view changes observed, capped at
+// t.ceiling, less one for every requestTimeoutDecayThreshold requests
+// committed since the most recent view change or decay step.
+func (t *adaptiveRequestTimeout) duration() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.base << t.viewChanges
+}
+
+// onViewChanged implements viewChangedHandler.
+func (t *adaptiveRequestTimeout) onViewChanged() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.viewChanges < t.ceiling {
+		t.viewChanges++
+	}
+	t.committed = 0
+}
+
+// onRequestCommitted implements requestCommittedHandler.
+func (t *adaptiveRequestTimeout) onRequestCommitted() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.viewChanges == 0 {
+		return
+	}
+
+	t.committed++
+	if t.committed >= requestTimeoutDecayThreshold {
+		t.committed = 0
+		t.viewChanges--
+	}
+}
+
 // makeRequestTimeoutProvider constructs an instance of
-// requestTimeoutProvider.
-func makeRequestTimeoutProvider(config api.Configer) requestTimeoutProvider {
-	// The View Change operation is not yet implemented, thus it
-	// simply returns the initial request timeout duration. When
-	// the View Change is implemented, this duration might be
-	// required to increase dynamically when the View Change is
-	// triggered, to guarantee liveness in case of increased
-	// network delay.
-	return func() time.Duration {
-		return config.TimeoutRequest()
+// requestTimeoutProvider, along with the viewChangedHandler and
+// requestCommittedHandler the view-change subsystem should invoke to
+// keep the provided timeout adjusted: the timeout backs off
+// exponentially on every view change and decays back towards the base
+// timeout once requestTimeoutDecayThreshold requests have been
+// committed in the current view. backoffCeiling caps how many
+// consecutive view changes may inflate the timeout; a zero
+// backoffCeiling falls back to defaultRequestTimeoutBackoffCeiling, so
+// operators can tune the cap without having to know the default.
+func makeRequestTimeoutProvider(config api.Configer, backoffCeiling uint32) (provide requestTimeoutProvider, onViewChanged viewChangedHandler, onRequestCommitted requestCommittedHandler) {
+	if backoffCeiling == 0 {
+		backoffCeiling = defaultRequestTimeoutBackoffCeiling
+	}
+
+	t := newAdaptiveRequestTimeout(config.TimeoutRequest(), backoffCeiling)
+
+	return t.duration, t.onViewChanged, t.onRequestCommitted
+}
+
+// requestDrainer is a RequestInterceptor that keeps count of every
+// Request whose processing has begun but not yet finished. It is
+// meant to be appended to the interceptor chain passed to both
+// makeRequestProcessor and makeRequestExecutor, so that a
+// requestPipeline built around it can wait for the count to reach
+// zero on Shutdown.
+type requestDrainer struct {
+	inFlight sync.WaitGroup
+}
+
+func (d *requestDrainer) Before(ctx context.Context, request *messages.Request) error {
+	d.inFlight.Add(1)
+	return nil
+}
+
+func (d *requestDrainer) After(ctx context.Context, request *messages.Request, result interface{}, err error) {
+	d.inFlight.Done()
+}
+
+// requestPipeline coordinates graceful shutdown of a replica's
+// request processing: it wraps requestValidator to stop accepting
+// new Request messages, relies on a requestDrainer interceptor wired
+// into the processing and execution stages to know when requests in
+// flight have finished, tracks outstanding per-client request timers
+// so they can be cancelled rather than left to fire, and potentially
+// trigger a view change, during the drain, and finally stops the
+// requestJobQueue's worker goroutines once the drain completes, so
+// that Shutdown leaves no goroutine behind.
+type requestPipeline struct {
+	validate   requestValidator
+	startTimer requestTimerStarter
+	stopTimer  requestTimerStopper
+	drainer    *requestDrainer
+	queue      *requestJobQueue
+
+	mu      sync.Mutex
+	stopped bool
+	timers  map[uint32]struct{}
+}
+
+// newRequestPipeline constructs a requestPipeline wrapping validate,
+// startTimer and stopTimer, and coordinating with drainer to know when
+// requests in flight through the processing and execution stages have
+// finished. drainer must also be part of the interceptor chain passed
+// to makeRequestProcessor and makeRequestExecutor. queue must be the
+// requestJobQueue returned alongside the requestExecutor built by
+// makeRequestExecutor, so that Shutdown can stop its workers once the
+// drain completes.
+func newRequestPipeline(validate requestValidator, startTimer requestTimerStarter, stopTimer requestTimerStopper, drainer *requestDrainer, queue *requestJobQueue) *requestPipeline {
+	return &requestPipeline{
+		validate:   validate,
+		startTimer: startTimer,
+		stopTimer:  stopTimer,
+		drainer:    drainer,
+		queue:      queue,
+		timers:     make(map[uint32]struct{}),
+	}
+}
+
+// Validate rejects Request messages once Shutdown has begun, and
+// otherwise defers to the wrapped requestValidator.
+func (p *requestPipeline) Validate(request *messages.Request) error {
+	p.mu.Lock()
+	stopped := p.stopped
+	p.mu.Unlock()
+
+	if stopped {
+		return fmt.Errorf("Replica is shutting down, Request rejected: client=%d seq=%d", request.Msg.ClientId, request.Msg.Seq)
+	}
+
+	return p.validate(request)
+}
+
+// StartTimer records clientID as having an outstanding request timer
+// before delegating to the wrapped requestTimerStarter.
+func (p *requestPipeline) StartTimer(clientID uint32, view uint64) {
+	p.mu.Lock()
+	p.timers[clientID] = struct{}{}
+	p.mu.Unlock()
+
+	p.startTimer(clientID, view)
+}
+
+// StopTimer forgets clientID's outstanding request timer before
+// delegating to the wrapped requestTimerStopper.
+func (p *requestPipeline) StopTimer(clientID uint32) {
+	p.mu.Lock()
+	delete(p.timers, clientID)
+	p.mu.Unlock()
+
+	p.stopTimer(clientID)
+}
+
+// Shutdown gracefully quiesces the pipeline: Validate starts rejecting
+// new Request messages, every request timer still outstanding is
+// cancelled so it cannot spuriously trigger a view change during the
+// drain, Shutdown waits for every Request already in flight through
+// processing and execution to finish, i.e. for its Reply, if any, to
+// be signed and delivered, and finally stops queue's worker goroutines
+// so that none are left running once Shutdown returns.
+//
+// If ctx is done before the drain completes, Shutdown stops waiting
+// and returns an error naming the clients whose request timer was
+// still outstanding, without stopping queue's workers, since requests
+// may still be in flight through them.
+func (p *requestPipeline) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopped = true
+	pending := make([]uint32, 0, len(p.timers))
+	for clientID := range p.timers {
+		pending = append(pending, clientID)
 	}
+	p.timers = make(map[uint32]struct{})
+	p.mu.Unlock()
+
+	for _, clientID := range pending {
+		p.stopTimer(clientID)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		p.drainer.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("Shutdown deadline exceeded with requests from clients %v still in flight", pending)
+	}
+
+	return p.queue.Shutdown(ctx)
+}
+
+// ClientHealth reports the observed health of a single client's
+// request stream, as tracked by a clientHealthMonitor.
+type ClientHealth struct {
+	Stalled             bool
+	LastReplyAt         time.Time
+	ConsecutiveTimeouts int
+}
+
+// clientHealthMonitor tracks, per client, whether its most recent
+// request timer expired without a matching Reply ever being signed
+// (stalled), logging exactly one warning on each stalled/healthy
+// transition rather than once per timeout tick, plus one info message
+// once the last stalled client recovers, and exposes the
+// current state via ClientHealth for operators and the view-change
+// logic to consume.
+//
+// It is safe to invoke its methods concurrently.
+type clientHealthMonitor struct {
+	logger *logging.Logger
+
+	mu           sync.Mutex
+	clients      map[uint32]*ClientHealth
+	stalledCount int
+}
+
+// newClientHealthMonitor constructs a clientHealthMonitor logging
+// transitions through logger.
+func newClientHealthMonitor(logger *logging.Logger) *clientHealthMonitor {
+	return &clientHealthMonitor{
+		logger:  logger,
+		clients: make(map[uint32]*ClientHealth),
+	}
+}
+
+// state returns clientID's health record, creating it, healthy, if
+// this is the first time clientID is observed. m.mu must be held.
+func (m *clientHealthMonitor) state(clientID uint32) *ClientHealth {
+	state, ok := m.clients[clientID]
+	if !ok {
+		state = &ClientHealth{}
+		m.clients[clientID] = state
+	}
+
+	return state
+}
+
+// onTimeout records that clientID's request timer has expired without
+// a matching Reply. It is meant to be invoked by the timeout callback
+// started by requestTimerStarter.
+func (m *clientHealthMonitor) onTimeout(clientID uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.state(clientID)
+	state.ConsecutiveTimeouts++
+
+	if state.Stalled {
+		return
+	}
+
+	state.Stalled = true
+	m.stalledCount++
+	m.logger.Warningf("Client stalled: client=%d consecutiveTimeouts=%d", clientID, state.ConsecutiveTimeouts)
+}
+
+// onReply records that a Reply has been signed for clientID at the
+// given time. It is meant to be invoked once the corresponding Reply
+// has been signed by the requestExecutor constructed around this
+// monitor.
+func (m *clientHealthMonitor) onReply(clientID uint32, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.state(clientID)
+	state.LastReplyAt = at
+
+	wasStalled := state.Stalled
+	state.Stalled = false
+	state.ConsecutiveTimeouts = 0
+
+	if !wasStalled {
+		return
+	}
+
+	m.logger.Warningf("Client recovered: client=%d", clientID)
+	m.stalledCount--
+	if m.stalledCount == 0 {
+		m.logger.Infof("All clients healthy")
+	}
+}
+
+// ClientHealth returns the current observed health of clientID. A
+// client never observed to have timed out or replied to is reported
+// healthy, with a zero LastReplyAt.
+func (m *clientHealthMonitor) ClientHealth(clientID uint32) (stalled bool, lastReplyAt time.Time, consecutiveTimeouts int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := m.state(clientID)
+
+	return state.Stalled, state.LastReplyAt, state.ConsecutiveTimeouts
 }
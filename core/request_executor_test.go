@@ -0,0 +1,80 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	logging "github.com/op/go-logging"
+
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+// TestMakeRequestExecutorRejectsWithoutSubmitting asserts that a
+// Request whose interceptor chain fails Before never reaches the
+// queue, that every interceptor whose Before already ran sees a
+// matching After, and that the rejection is logged rather than
+// silently dropped.
+func TestMakeRequestExecutorRejectsWithoutSubmitting(t *testing.T) {
+	health, backend := newTestHealthMonitor()
+
+	var trace []string
+	beforeErr := errors.New("rejected")
+	interceptors := []RequestInterceptor{
+		&recordingInterceptor{name: "a", trace: &trace},
+		&recordingInterceptor{name: "b", trace: &trace, beforeErr: beforeErr},
+		&recordingInterceptor{name: "c", trace: &trace},
+	}
+
+	submitted := false
+	execute, queue := makeRequestExecutor(
+		1,
+		func(op []byte) <-chan []byte {
+			submitted = true
+			result := make(chan []byte, 1)
+			result <- op
+			return result
+		},
+		func(msg *messages.Reply) {},
+		func(msg *messages.Reply) {},
+		NewMemoryJobStore(),
+		1,
+		health,
+		interceptors,
+	)
+	defer func() {
+		if err := queue.Shutdown(context.Background()); err != nil {
+			t.Fatalf("unexpected error shutting down queue: %s", err)
+		}
+	}()
+
+	execute(newRequest(1, 1))
+
+	if submitted {
+		t.Fatal("operationExecutor must not run once a Before call fails")
+	}
+
+	want := []string{"before:a", "before:b", "after:b", "after:a"}
+	assertTraceEqual(t, trace, want)
+
+	if warnings := countAtLevel(backend.records, logging.WARNING); warnings != 1 {
+		t.Fatalf("expected exactly one warning logging the dropped request, got %d", warnings)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"testing"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+// recordingBackend collects every log record handed to it, so tests
+// can count how many times, and at what level, clientHealthMonitor
+// actually logged, rather than just asserting on its exposed state.
+type recordingBackend struct {
+	records []logging.Record
+}
+
+func (b *recordingBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	b.records = append(b.records, *record)
+	return nil
+}
+
+func newTestHealthMonitor() (*clientHealthMonitor, *recordingBackend) {
+	backend := &recordingBackend{}
+	logger := logging.MustGetLogger("minbft-test")
+	logger.SetBackend(logging.AddModuleLevel(backend))
+
+	return newClientHealthMonitor(logger), backend
+}
+
+// TestClientHealthMonitorWarnsOnceOnRepeatedTimeouts asserts that
+// repeated timer expirations for a client that never replies produce
+// exactly one Warningf, on the healthy-to-stalled transition, rather
+// than one per timeout tick.
+func TestClientHealthMonitorWarnsOnceOnRepeatedTimeouts(t *testing.T) {
+	monitor, backend := newTestHealthMonitor()
+
+	for i := 0; i < 5; i++ {
+		monitor.onTimeout(42)
+	}
+
+	warnings := countAtLevel(backend.records, logging.WARNING)
+	if warnings != 1 {
+		t.Fatalf("expected exactly one warning for repeated timeouts, got %d", warnings)
+	}
+
+	stalled, _, consecutive := monitor.ClientHealth(42)
+	if !stalled {
+		t.Fatal("expected client to be reported stalled")
+	}
+	if consecutive != 5 {
+		t.Fatalf("expected 5 consecutive timeouts, got %d", consecutive)
+	}
+}
+
+// TestClientHealthMonitorLogsAllClientsHealthyTransition asserts that
+// an Infof is emitted exactly when the last stalled client recovers,
+// transitioning the replica from any-client-stalled to
+// all-clients-healthy, and not before.
+func TestClientHealthMonitorLogsAllClientsHealthyTransition(t *testing.T) {
+	monitor, backend := newTestHealthMonitor()
+
+	monitor.onTimeout(1)
+	monitor.onTimeout(2)
+
+	monitor.onReply(1, time.Now())
+	if countAtLevel(backend.records, logging.INFO) != 0 {
+		t.Fatal("did not expect an all-clients-healthy log while client 2 is still stalled")
+	}
+
+	monitor.onReply(2, time.Now())
+	if infos := countAtLevel(backend.records, logging.INFO); infos != 1 {
+		t.Fatalf("expected exactly one all-clients-healthy log, got %d", infos)
+	}
+
+	stalled, _, consecutive := monitor.ClientHealth(2)
+	if stalled {
+		t.Fatal("expected client 2 to be reported healthy")
+	}
+	if consecutive != 0 {
+		t.Fatalf("expected consecutive timeouts to reset to 0, got %d", consecutive)
+	}
+}
+
+func countAtLevel(records []logging.Record, level logging.Level) int {
+	count := 0
+	for _, record := range records {
+		if record.Level == level {
+			count++
+		}
+	}
+	return count
+}
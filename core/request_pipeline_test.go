@@ -0,0 +1,107 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/goleak"
+
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+// rejectOddSeqInterceptor fails Before for every request whose
+// sequence number is odd, so tests can exercise the short-circuit path
+// of the interceptor chain alongside the drainer.
+type rejectOddSeqInterceptor struct{}
+
+func (rejectOddSeqInterceptor) Before(ctx context.Context, request *messages.Request) error {
+	if request.Msg.Seq%2 != 0 {
+		return fmt.Errorf("rejected: seq=%d", request.Msg.Seq)
+	}
+	return nil
+}
+
+func (rejectOddSeqInterceptor) After(ctx context.Context, request *messages.Request, result interface{}, err error) {
+}
+
+// TestRequestPipelineDrainsRejectedAndAcceptedRequests exercises
+// requestDrainer through makeRequestProcessor, via
+// runInterceptedStage, with a mix of requests some of which are
+// rejected by a later interceptor's Before, then shuts down a pipeline
+// built around that drainer and a bare requestJobQueue. Before the fix to runInterceptedStage
+// and makeRequestExecutor, a rejected request left the drainer's
+// inFlight WaitGroup unbalanced: Shutdown either panicked
+// ("negative WaitGroup counter") or hung forever.
+func TestRequestPipelineDrainsRejectedAndAcceptedRequests(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	drainer := &requestDrainer{}
+	interceptors := []RequestInterceptor{drainer, rejectOddSeqInterceptor{}}
+
+	processor := makeRequestProcessor(
+		func(request *messages.Request) (bool, func()) { return true, func() {} },
+		func(request *messages.Request) error { return nil },
+		interceptors,
+	)
+
+	var wg sync.WaitGroup
+	for seq := uint64(0); seq < 20; seq++ {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			// A panic here, from an unbalanced WaitGroup, would
+			// fail the test via the runtime's default panic
+			// handling of the goroutine.
+			processor(newRequest(1, seq))
+		}(seq)
+	}
+	wg.Wait()
+
+	queue := newRequestJobQueue(
+		1,
+		func(op []byte) <-chan []byte {
+			result := make(chan []byte, 1)
+			result <- op
+			return result
+		},
+		func(msg *messages.Reply) {},
+		func(request *messages.Request, reply *messages.Reply) {},
+		NewMemoryJobStore(),
+		1,
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	pipeline := newRequestPipeline(
+		func(request *messages.Request) error { return nil },
+		func(clientID uint32, view uint64) {},
+		func(clientID uint32) {},
+		drainer,
+		queue,
+	)
+
+	if err := pipeline.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown should not have blocked on the drain: %s", err)
+	}
+}
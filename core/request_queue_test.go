@@ -0,0 +1,245 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/goleak"
+
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+// TestRequestJobQueueShutdownStopsWorkers ensures Shutdown does not
+// leave any worker goroutine behind once it returns.
+func TestRequestJobQueueShutdownStopsWorkers(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	var completed sync.WaitGroup
+	completed.Add(1)
+
+	queue := newRequestJobQueue(
+		1,
+		func(op []byte) <-chan []byte {
+			result := make(chan []byte, 1)
+			result <- op
+			return result
+		},
+		func(msg *messages.Reply) {},
+		func(request *messages.Request, reply *messages.Reply) {
+			completed.Done()
+		},
+		NewMemoryJobStore(),
+		2,
+	)
+
+	queue.Submit(newRequest(1, 1))
+	completed.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := queue.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error shutting down queue: %s", err)
+	}
+}
+
+// TestReplayPendingJobsRedrivesHalfProcessedRequest simulates a crash
+// between a job being marked executing and its Reply being signed: the
+// job store, which survives the simulated crash, still reports the
+// request as pending, and replayPendingJobs must re-submit it to a
+// freshly constructed queue exactly once.
+func TestReplayPendingJobsRedrivesHalfProcessedRequest(t *testing.T) {
+	store := NewMemoryJobStore()
+	request := newRequest(7, 3)
+
+	if err := store.Enqueue(request); err != nil {
+		t.Fatalf("unexpected error enqueuing job: %s", err)
+	}
+	if err := store.MarkExecuting(request.Msg.ClientId, request.Msg.Seq); err != nil {
+		t.Fatalf("unexpected error marking job executing: %s", err)
+	}
+	// No MarkCompleted: this simulates a crash after execution began
+	// but before the Reply was signed and delivered.
+
+	var executions int
+	var completions int
+	var mu sync.Mutex
+	completed := make(chan struct{}, 1)
+
+	queue := newRequestJobQueue(
+		1,
+		func(op []byte) <-chan []byte {
+			mu.Lock()
+			executions++
+			mu.Unlock()
+
+			result := make(chan []byte, 1)
+			result <- op
+			return result
+		},
+		func(msg *messages.Reply) {},
+		func(request *messages.Request, reply *messages.Reply) {
+			mu.Lock()
+			completions++
+			mu.Unlock()
+			completed <- struct{}{}
+		},
+		store,
+		1,
+	)
+
+	replayPendingJobs(store, queue)
+
+	<-completed
+
+	// MarkDelivered runs only after onComplete returns; stopping the
+	// queue waits for the worker to get there.
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down queue: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if executions != 1 {
+		t.Fatalf("expected exactly one execution of the replayed job, got %d", executions)
+	}
+	if completions != 1 {
+		t.Fatalf("expected exactly one completion of the replayed job, got %d", completions)
+	}
+
+	pending := store.PendingJobs()
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending jobs after replay completed, got %d", len(pending))
+	}
+}
+
+// TestReplayPendingJobsRedeliversCompletedButUndeliveredRequest
+// simulates a crash between a job's Reply being signed and it being
+// delivered: the job store reports the request as Completed, but not
+// Delivered, and replayPendingJobs must redeliver the already-computed
+// Reply to a freshly constructed queue without executing the
+// operation again.
+func TestReplayPendingJobsRedeliversCompletedButUndeliveredRequest(t *testing.T) {
+	store := NewMemoryJobStore()
+	request := newRequest(11, 4)
+
+	if err := store.Enqueue(request); err != nil {
+		t.Fatalf("unexpected error enqueuing job: %s", err)
+	}
+	if err := store.MarkExecuting(request.Msg.ClientId, request.Msg.Seq); err != nil {
+		t.Fatalf("unexpected error marking job executing: %s", err)
+	}
+	if err := store.MarkCompleted(request.Msg.ClientId, request.Msg.Seq, []byte("result"), []byte("signature")); err != nil {
+		t.Fatalf("unexpected error marking job completed: %s", err)
+	}
+	// No MarkDelivered: this simulates a crash after the Reply was
+	// signed and persisted, but before it reached handleGeneratedMessage.
+
+	var executions int
+	var mu sync.Mutex
+	delivered := make(chan *messages.Reply, 1)
+
+	queue := newRequestJobQueue(
+		1,
+		func(op []byte) <-chan []byte {
+			mu.Lock()
+			executions++
+			mu.Unlock()
+
+			result := make(chan []byte, 1)
+			result <- op
+			return result
+		},
+		func(msg *messages.Reply) {},
+		func(request *messages.Request, reply *messages.Reply) {
+			delivered <- reply
+		},
+		store,
+		1,
+	)
+
+	replayPendingJobs(store, queue)
+
+	reply := <-delivered
+
+	// MarkDelivered runs only after onComplete returns; stopping the
+	// queue waits for the worker to get there.
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down queue: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if executions != 0 {
+		t.Fatalf("expected the operation not to be re-executed, got %d executions", executions)
+	}
+	if string(reply.Msg.Result) != "result" || string(reply.Signature) != "signature" {
+		t.Fatalf("expected the already-computed Reply to be redelivered, got %+v", reply)
+	}
+
+	pending := store.PendingJobs()
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending jobs after redelivery completed, got %d", len(pending))
+	}
+}
+
+// TestBoltJobStorePendingJobsSurviveReopen verifies that a job
+// enqueued, but never completed, is still reported by PendingJobs
+// after the store is closed and reopened at the same path, i.e. across
+// a simulated restart.
+func TestBoltJobStorePendingJobsSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requestjobs.db")
+
+	store, err := NewBoltJobStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error opening store: %s", err)
+	}
+
+	request := newRequest(9, 5)
+	if err := store.Enqueue(request); err != nil {
+		t.Fatalf("unexpected error enqueuing job: %s", err)
+	}
+	if err := store.MarkExecuting(request.Msg.ClientId, request.Msg.Seq); err != nil {
+		t.Fatalf("unexpected error marking job executing: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("unexpected error closing store: %s", err)
+	}
+
+	reopened, err := NewBoltJobStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reopening store: %s", err)
+	}
+	defer reopened.Close()
+
+	pending := reopened.PendingJobs()
+	if len(pending) != 1 {
+		t.Fatalf("expected exactly one pending job after reopening, got %d", len(pending))
+	}
+	if pending[0].Request.Msg.ClientId != request.Msg.ClientId || pending[0].Request.Msg.Seq != request.Msg.Seq {
+		t.Fatalf("unexpected pending job: %+v", pending[0])
+	}
+	if !pending[0].Executing {
+		t.Fatal("expected the replayed job to still be marked executing")
+	}
+}
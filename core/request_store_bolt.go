@@ -0,0 +1,226 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+var requestJobsBucket = []byte("requestJobs")
+
+// boltJobRecord is the on-disk representation of a single Job tracked
+// by boltJobStore. Order preserves the relative Enqueue order across
+// restarts, since BoltDB iterates a bucket's keys byte-wise rather
+// than in insertion order, and PendingJobs must return jobs in the
+// order they were enqueued.
+type boltJobRecord struct {
+	Order       uint64
+	RequestData []byte
+	Executing   bool
+	Completed   bool
+	Delivered   bool
+	Result      []byte
+	Signature   []byte
+}
+
+// boltJobStore is the optional, durable RequestJobStore backed by
+// BoltDB: unlike memoryJobStore, its PendingJobs survive a process
+// restart, so that the replica constructor's call to replayPendingJobs
+// can re-drive a Request that was accepted, but never replied to,
+// before a crash.
+type boltJobStore struct {
+	db *bolt.DB
+}
+
+// NewBoltJobStore opens, creating if necessary, a BoltDB-backed
+// RequestJobStore at path. The caller is responsible for calling
+// Close once the store is no longer needed.
+func NewBoltJobStore(path string) (*boltJobStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open request job store: %s", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(requestJobsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to initialize request job store: %s", err)
+	}
+
+	return &boltJobStore{db: db}, nil
+}
+
+// Close releases the underlying BoltDB file.
+func (s *boltJobStore) Close() error {
+	return s.db.Close()
+}
+
+func requestJobKey(clientID uint32, seq uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key[0:4], clientID)
+	binary.BigEndian.PutUint64(key[4:12], seq)
+	return key
+}
+
+func (s *boltJobStore) Enqueue(request *messages.Request) error {
+	key := requestJobKey(request.Msg.ClientId, request.Msg.Seq)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(requestJobsBucket)
+
+		if bucket.Get(key) != nil {
+			return nil
+		}
+
+		data, err := proto.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal Request: %s", err)
+		}
+
+		order, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return putBoltJobRecord(bucket, key, &boltJobRecord{Order: order, RequestData: data})
+	})
+}
+
+func (s *boltJobStore) MarkExecuting(clientID uint32, seq uint64) error {
+	return s.update(clientID, seq, func(record *boltJobRecord) {
+		record.Executing = true
+	})
+}
+
+func (s *boltJobStore) MarkCompleted(clientID uint32, seq uint64, result, signature []byte) error {
+	return s.update(clientID, seq, func(record *boltJobRecord) {
+		record.Result = result
+		record.Signature = signature
+		record.Completed = true
+	})
+}
+
+func (s *boltJobStore) MarkDelivered(clientID uint32, seq uint64) error {
+	return s.update(clientID, seq, func(record *boltJobRecord) {
+		record.Delivered = true
+	})
+}
+
+func (s *boltJobStore) update(clientID uint32, seq uint64, mutate func(*boltJobRecord)) error {
+	key := requestJobKey(clientID, seq)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(requestJobsBucket)
+
+		record, err := getBoltJobRecord(bucket, key)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			return fmt.Errorf("Request job not found: client=%d seq=%d", clientID, seq)
+		}
+
+		mutate(record)
+
+		return putBoltJobRecord(bucket, key, record)
+	})
+}
+
+func (s *boltJobStore) PendingJobs() []Job {
+	type ordered struct {
+		job   Job
+		order uint64
+	}
+
+	var pending []ordered
+
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(requestJobsBucket)
+
+		return bucket.ForEach(func(key, value []byte) error {
+			var record boltJobRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if record.Delivered {
+				return nil
+			}
+
+			request := &messages.Request{}
+			if err := proto.Unmarshal(record.RequestData, request); err != nil {
+				return err
+			}
+
+			pending = append(pending, ordered{
+				job: Job{
+					Request:   request,
+					Executing: record.Executing,
+					Completed: record.Completed,
+					Delivered: record.Delivered,
+					Result:    record.Result,
+					Signature: record.Signature,
+				},
+				order: record.Order,
+			})
+
+			return nil
+		})
+	})
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].order < pending[j].order })
+
+	jobs := make([]Job, len(pending))
+	for i, p := range pending {
+		jobs[i] = p.job
+	}
+
+	return jobs
+}
+
+func getBoltJobRecord(bucket *bolt.Bucket, key []byte) (*boltJobRecord, error) {
+	value := bucket.Get(key)
+	if value == nil {
+		return nil, nil
+	}
+
+	var record boltJobRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func putBoltJobRecord(bucket *bolt.Bucket, key []byte, record *boltJobRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, value)
+}
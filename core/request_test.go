@@ -0,0 +1,163 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger-labs/minbft/messages"
+)
+
+// recordingInterceptor tracks the order in which Before and After are
+// invoked on it, and optionally fails Before or panics inside it, so
+// tests can assert on interceptor-chain behavior without a mock
+// framework.
+type recordingInterceptor struct {
+	name       string
+	beforeErr  error
+	panicStage bool
+	trace      *[]string
+}
+
+func (i *recordingInterceptor) Before(ctx context.Context, request *messages.Request) error {
+	*i.trace = append(*i.trace, "before:"+i.name)
+	return i.beforeErr
+}
+
+func (i *recordingInterceptor) After(ctx context.Context, request *messages.Request, result interface{}, err error) {
+	*i.trace = append(*i.trace, "after:"+i.name)
+}
+
+func newRequest(clientID uint32, seq uint64) *messages.Request {
+	return &messages.Request{Msg: &messages.Request_M{ClientId: clientID, Seq: seq}}
+}
+
+func TestRunInterceptedStageOrdering(t *testing.T) {
+	var trace []string
+	interceptors := []RequestInterceptor{
+		&recordingInterceptor{name: "a", trace: &trace},
+		&recordingInterceptor{name: "b", trace: &trace},
+	}
+
+	result, err := runInterceptedStage(context.Background(), interceptors, newRequest(1, 1), func() (interface{}, error) {
+		trace = append(trace, "stage")
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result != "ok" {
+		t.Fatalf("unexpected result: %v", result)
+	}
+
+	want := []string{"before:a", "before:b", "stage", "after:b", "after:a"}
+	assertTraceEqual(t, trace, want)
+}
+
+func TestRunInterceptedStageShortCircuit(t *testing.T) {
+	var trace []string
+	beforeErr := errors.New("rejected")
+	interceptors := []RequestInterceptor{
+		&recordingInterceptor{name: "a", trace: &trace},
+		&recordingInterceptor{name: "b", trace: &trace, beforeErr: beforeErr},
+		&recordingInterceptor{name: "c", trace: &trace},
+	}
+
+	stageRan := false
+	_, err := runInterceptedStage(context.Background(), interceptors, newRequest(1, 1), func() (interface{}, error) {
+		stageRan = true
+		return nil, nil
+	})
+	if err != beforeErr {
+		t.Fatalf("expected %v, got %v", beforeErr, err)
+	}
+	if stageRan {
+		t.Fatal("stage must not run once a Before call fails")
+	}
+
+	// Interceptor "c" never had Before invoked, so it must not see
+	// After; "a" and "b" did, so both must, in reverse order.
+	want := []string{"before:a", "before:b", "after:b", "after:a"}
+	assertTraceEqual(t, trace, want)
+}
+
+func TestRunInterceptedStagePanicRecovery(t *testing.T) {
+	var trace []string
+	interceptors := []RequestInterceptor{
+		&recordingInterceptor{name: "a", trace: &trace},
+		&recordingInterceptor{name: "b", trace: &trace},
+	}
+
+	defer func() {
+		p := recover()
+		if p == nil {
+			t.Fatal("expected panic to be re-raised")
+		}
+
+		want := []string{"before:a", "before:b", "after:b", "after:a"}
+		assertTraceEqual(t, trace, want)
+	}()
+
+	runInterceptedStage(context.Background(), interceptors, newRequest(1, 1), func() (interface{}, error) {
+		panic("boom")
+	})
+}
+
+func TestRequestDrainerBalancedOnShortCircuit(t *testing.T) {
+	drainer := &requestDrainer{}
+	interceptors := []RequestInterceptor{
+		drainer,
+		&recordingInterceptor{name: "rejecting", trace: &[]string{}, beforeErr: fmt.Errorf("nope")},
+	}
+
+	_, err := runInterceptedStage(context.Background(), interceptors, newRequest(1, 1), func() (interface{}, error) {
+		t.Fatal("stage must not run once a Before call fails")
+		return nil, nil
+	})
+	if err == nil {
+		t.Fatal("expected an error from the rejecting interceptor")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		drainer.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	default:
+		t.Fatal("requestDrainer.inFlight must already be balanced once the chain short-circuits")
+	}
+}
+
+func assertTraceEqual(t *testing.T, got, want []string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("trace length mismatch: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("trace mismatch at %d: got %v, want %v", i, got, want)
+		}
+	}
+}
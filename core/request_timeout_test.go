@@ -0,0 +1,137 @@
+// Copyright (c) 2018 NEC Laboratories Europe GmbH.
+//
+// Authors: Wenting Li <wenting.li@neclab.eu>
+//          Sergey Fedorov <sergey.fedorov@neclab.eu>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package minbft
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAdaptiveRequestTimeoutBackoffIsMonotonic simulates a burst of
+// view changes and asserts that the timeout backs off monotonically on
+// each one, capped at the configured ceiling.
+func TestAdaptiveRequestTimeoutBackoffIsMonotonic(t *testing.T) {
+	const ceiling = 6
+
+	base := 100 * time.Millisecond
+	timeout := newAdaptiveRequestTimeout(base, ceiling)
+
+	if got := timeout.duration(); got != base {
+		t.Fatalf("expected base timeout %s before any view change, got %s", base, got)
+	}
+
+	prev := timeout.duration()
+	for i := 0; i < ceiling+3; i++ {
+		timeout.onViewChanged()
+
+		got := timeout.duration()
+		if got < prev {
+			t.Fatalf("backoff must be monotonic: timeout dropped from %s to %s after view change %d", prev, got, i)
+		}
+		prev = got
+	}
+
+	want := base << ceiling
+	if prev != want {
+		t.Fatalf("expected backoff to be capped at %s, got %s", want, prev)
+	}
+}
+
+// TestAdaptiveRequestTimeoutDecaysAfterCommits simulates a single view
+// change followed by enough committed requests for the timeout to
+// decay back to its base value, and asserts it does not decay early.
+func TestAdaptiveRequestTimeoutDecaysAfterCommits(t *testing.T) {
+	base := 100 * time.Millisecond
+	timeout := newAdaptiveRequestTimeout(base, 6)
+
+	timeout.onViewChanged()
+	backedOff := timeout.duration()
+	if backedOff != base*2 {
+		t.Fatalf("expected timeout to double after one view change, got %s", backedOff)
+	}
+
+	for i := 0; i < requestTimeoutDecayThreshold-1; i++ {
+		timeout.onRequestCommitted()
+		if got := timeout.duration(); got != backedOff {
+			t.Fatalf("timeout must not decay before %d requests commit, got %s after %d", requestTimeoutDecayThreshold, got, i+1)
+		}
+	}
+
+	timeout.onRequestCommitted()
+	if got := timeout.duration(); got != base {
+		t.Fatalf("expected timeout to decay back to base %s after %d committed requests, got %s", base, requestTimeoutDecayThreshold, got)
+	}
+}
+
+// TestAdaptiveRequestTimeoutIgnoresCommitsAtBase asserts that
+// committing requests while already at the base timeout, i.e. with no
+// view changes to decay away, leaves the timeout unchanged.
+func TestAdaptiveRequestTimeoutIgnoresCommitsAtBase(t *testing.T) {
+	base := 100 * time.Millisecond
+	timeout := newAdaptiveRequestTimeout(base, 6)
+
+	for i := 0; i < requestTimeoutDecayThreshold*2; i++ {
+		timeout.onRequestCommitted()
+	}
+
+	if got := timeout.duration(); got != base {
+		t.Fatalf("expected timeout to stay at base %s, got %s", base, got)
+	}
+}
+
+// fakeConfiger is the minimal api.Configer stand-in these tests need:
+// a fixed base request timeout.
+type fakeConfiger struct {
+	timeoutRequest time.Duration
+}
+
+func (c fakeConfiger) TimeoutRequest() time.Duration { return c.timeoutRequest }
+
+// TestMakeRequestTimeoutProviderDefaultsCeiling asserts that a zero
+// backoffCeiling falls back to defaultRequestTimeoutBackoffCeiling,
+// rather than capping backoff at zero view changes.
+func TestMakeRequestTimeoutProviderDefaultsCeiling(t *testing.T) {
+	base := 100 * time.Millisecond
+	provide, onViewChanged, _ := makeRequestTimeoutProvider(fakeConfiger{timeoutRequest: base}, 0)
+
+	for i := 0; i < defaultRequestTimeoutBackoffCeiling+3; i++ {
+		onViewChanged()
+	}
+
+	want := base << defaultRequestTimeoutBackoffCeiling
+	if got := provide(); got != want {
+		t.Fatalf("expected backoff capped at default ceiling %s, got %s", want, got)
+	}
+}
+
+// TestMakeRequestTimeoutProviderHonorsExplicitCeiling asserts that a
+// non-zero backoffCeiling is used instead of the default.
+func TestMakeRequestTimeoutProviderHonorsExplicitCeiling(t *testing.T) {
+	base := 100 * time.Millisecond
+	const ceiling = 2
+	provide, onViewChanged, _ := makeRequestTimeoutProvider(fakeConfiger{timeoutRequest: base}, ceiling)
+
+	for i := 0; i < ceiling+3; i++ {
+		onViewChanged()
+	}
+
+	want := base << ceiling
+	if got := provide(); got != want {
+		t.Fatalf("expected backoff capped at explicit ceiling %s, got %s", want, got)
+	}
+}